@@ -0,0 +1,141 @@
+// Package ipset is a thin wrapper around the ipset(8) command line tool,
+// used by weave-npc to maintain the sets of pod/namespace IPs that its
+// iptables rules match against.
+package ipset
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Name is the name of an ipset.
+type Name string
+
+// Type is an ipset type, e.g. "hash:ip".
+type Type string
+
+const (
+	HashIP  Type = "hash:ip"
+	HashMac Type = "hash:mac"
+	HashNet Type = "hash:net"
+	ListSet Type = "list:set"
+)
+
+// Family is the address family of the entries an ipset holds.
+type Family string
+
+const (
+	FamilyV4 Family = "inet"
+	FamilyV6 Family = "inet6"
+)
+
+// Logger is the subset of a logging interface ipset needs; satisfied by
+// common.LogLogger().
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// Interface is the set of ipset operations weave-npc needs.
+type Interface interface {
+	Create(name Name, setType Type) error
+	AddEntry(setName Name, entry string, comment string) error
+	DelEntry(setName Name, entry string) error
+	Flush(name Name) error
+	Destroy(name Name) error
+	List(prefix string) ([]Name, error)
+}
+
+type ipset struct {
+	logger  Logger
+	maxList int
+	family  Family
+}
+
+// New returns an Interface managing IPv4 ipsets.
+func New(logger Logger, maxListSize int) Interface {
+	return NewWithFamily(logger, maxListSize, FamilyV4)
+}
+
+// NewWithFamily returns an Interface managing ipsets of the given address
+// family, so a dual-stack weave-npc can keep one IPv4 and one IPv6 ipset
+// per logical set (e.g. "weave-local-pods" backed by a hash:ip and a
+// hash:ip,family inet6 set respectively).
+func NewWithFamily(logger Logger, maxListSize int, family Family) Interface {
+	return &ipset{logger: logger, maxList: maxListSize, family: family}
+}
+
+// typeHasFamily reports whether setType's ipset entries are address-typed
+// and so accept a "family" option at creation time. list:set holds other
+// ipsets (no addresses of its own) and hash:mac holds MAC addresses;
+// "ipset create ... family inet6" is rejected for both.
+func typeHasFamily(setType Type) bool {
+	return setType == HashIP || setType == HashNet
+}
+
+func (i *ipset) Create(name Name, setType Type) error {
+	args := []string{"create", string(name), string(setType), "-exist"}
+	if i.family == FamilyV6 && typeHasFamily(setType) {
+		args = append(args, "family", "inet6")
+	}
+	if setType == ListSet {
+		args = append(args, "size", fmt.Sprintf("%d", i.maxList))
+	}
+	return i.exec(args...)
+}
+
+func (i *ipset) AddEntry(setName Name, entry string, comment string) error {
+	args := []string{"add", string(setName), entry, "-exist"}
+	if comment != "" {
+		args = append(args, "comment", comment)
+	}
+	return i.exec(args...)
+}
+
+func (i *ipset) DelEntry(setName Name, entry string) error {
+	return i.exec("del", string(setName), entry, "-exist")
+}
+
+func (i *ipset) Flush(name Name) error {
+	return i.exec("flush", string(name))
+}
+
+func (i *ipset) Destroy(name Name) error {
+	return i.exec("destroy", string(name))
+}
+
+// List returns the names of ipsets whose name begins with prefix.
+func (i *ipset) List(prefix string) ([]Name, error) {
+	out, err := i.run("list", "-name")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []Name
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" || !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		names = append(names, Name(line))
+	}
+	return names, nil
+}
+
+func (i *ipset) exec(args ...string) error {
+	_, err := i.run(args...)
+	return err
+}
+
+func (i *ipset) run(args ...string) (string, error) {
+	cmd := exec.Command("ipset", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "ipset %s: %s", strings.Join(args, " "), out.String())
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,30 @@
+package npc
+
+import "github.com/weaveworks/weave/net/ipset"
+
+// Chain and ipset names shared between weave-npc's iptables setup
+// (prog/weave-npc/main.go) and the desired-state rendering in
+// controller.go.
+const (
+	TableFilter = "filter"
+
+	MainChain          = "WEAVE-NPC"
+	DefaultChain       = "WEAVE-NPC-DEFAULT"
+	IngressChain       = "WEAVE-NPC-INGRESS"
+	EgressChain        = "WEAVE-NPC-EGRESS"
+	EgressMarkChain    = "WEAVE-NPC-EGRESS-MARK"
+	EgressCustomChain  = "WEAVE-NPC-EGRESS-CUSTOM"
+	EgressDefaultChain = "WEAVE-NPC-EGRESS-DEFAULT"
+
+	// EgressMark marks packets that have passed egress policy, so the
+	// final rule in WEAVE-NPC-EGRESS can drop anything left unmarked.
+	EgressMark = "0x40000/0x40000"
+
+	// IpsetNamePrefix is prepended to every ipset weave-npc creates, so
+	// a reset can find and remove only its own sets.
+	IpsetNamePrefix = "weave-"
+)
+
+// LocalIpset holds the IPs of every pod running on this node; it backs
+// the "destination not local, just ACCEPT" rule in WEAVE-NPC.
+var LocalIpset = ipset.Name(IpsetNamePrefix + "local-pods")
@@ -0,0 +1,307 @@
+package npc
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	coreapi "k8s.io/api/core/v1"
+	extnapi "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/weaveworks/weave/net/ipset"
+)
+
+// NPC tracks the namespaces, pods and NetworkPolicies relevant to this
+// node and renders them into the desired iptables/ipset state for each
+// enabled address family on demand, via DesiredState. The handlers below
+// only mutate this in-memory state and enqueue a resync on every enabled
+// family's Reconciler; applying the result to iptables/ipset is the Reconciler's
+// job, not theirs.
+type NPC struct {
+	nodeName              string
+	legacy                bool
+	honorLegacyAnnotation bool
+
+	mu         sync.Mutex
+	backends   map[Family]FamilyBackend
+	namespaces map[string]*nsState
+	pods       map[types.UID]*podState
+	policies   map[string]*policyState
+}
+
+type nsState struct {
+	labels            labels.Set
+	legacyDefaultDeny bool
+}
+
+type podState struct {
+	namespace string
+	labels    labels.Set
+	ips       map[Family]string
+}
+
+// familyOf returns the address family of ip, or "" if ip doesn't parse.
+func familyOf(ip string) Family {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return FamilyV4
+	default:
+		return FamilyV6
+	}
+}
+
+// podIPs collects a pod's addresses by family from its dual-stack
+// .status.podIPs list, falling back to the single-stack .status.podIP
+// for older kubelets that don't populate podIPs.
+func podIPs(pod *coreapi.Pod) map[Family]string {
+	ips := make(map[Family]string, 2)
+	for _, podIP := range pod.Status.PodIPs {
+		if f := familyOf(podIP.IP); f != "" {
+			ips[f] = podIP.IP
+		}
+	}
+	if len(ips) == 0 {
+		if f := familyOf(pod.Status.PodIP); f != "" {
+			ips[f] = pod.Status.PodIP
+		}
+	}
+	return ips
+}
+
+type policyState struct {
+	namespace   string
+	podSelector labels.Selector
+}
+
+// New creates an NPC that enforces NetworkPolicy for pods scheduled to
+// nodeName, applying it through backends (one per enabled, available
+// address family).
+func New(nodeName string, legacy bool, backends []FamilyBackend, honorLegacyAnnotation bool) *NPC {
+	byFamily := make(map[Family]FamilyBackend, len(backends))
+	for _, b := range backends {
+		byFamily[b.Family] = b
+	}
+	return &NPC{
+		nodeName:              nodeName,
+		legacy:                legacy,
+		honorLegacyAnnotation: honorLegacyAnnotation,
+		backends:              byFamily,
+		namespaces:            make(map[string]*nsState),
+		pods:                  make(map[types.UID]*podState),
+		policies:              make(map[string]*policyState),
+	}
+}
+
+// enqueueAll requests a resync of every enabled family's Reconciler. A
+// change to any namespace, pod or policy can affect the desired state of
+// any family, since NetworkPolicy selectors aren't family-specific.
+func (n *NPC) enqueueAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, b := range n.backends {
+		b.Reconciler.Enqueue()
+	}
+}
+
+func (n *NPC) AddPod(obj *coreapi.Pod) error {
+	if obj.Spec.NodeName != "" && obj.Spec.NodeName != n.nodeName {
+		return n.DeletePod(obj)
+	}
+
+	n.mu.Lock()
+	n.pods[obj.UID] = &podState{
+		namespace: obj.Namespace,
+		labels:    labels.Set(obj.Labels),
+		ips:       podIPs(obj),
+	}
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+func (n *NPC) UpdatePod(old, new *coreapi.Pod) error {
+	return n.AddPod(new)
+}
+
+func (n *NPC) DeletePod(obj *coreapi.Pod) error {
+	n.mu.Lock()
+	delete(n.pods, obj.UID)
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+func (n *NPC) AddNamespace(ns *coreapi.Namespace) error {
+	n.mu.Lock()
+	n.namespaces[ns.Name] = &nsState{
+		labels:            labels.Set(ns.Labels),
+		legacyDefaultDeny: n.honorLegacyAnnotation && IsLegacyDefaultDenyAnnotated(ns),
+	}
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+func (n *NPC) UpdateNamespace(old, new *coreapi.Namespace) error {
+	return n.AddNamespace(new)
+}
+
+func (n *NPC) DeleteNamespace(ns *coreapi.Namespace) error {
+	n.mu.Lock()
+	delete(n.namespaces, ns.Name)
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+func (n *NPC) AddNetworkPolicy(obj interface{}) error {
+	key, ps, err := normalizePolicy(obj)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.policies[key] = ps
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+func (n *NPC) UpdateNetworkPolicy(old, new interface{}) error {
+	return n.AddNetworkPolicy(new)
+}
+
+func (n *NPC) DeleteNetworkPolicy(obj interface{}) error {
+	key, _, err := normalizePolicy(obj)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	delete(n.policies, key)
+	n.mu.Unlock()
+
+	n.enqueueAll()
+	return nil
+}
+
+// normalizePolicy extracts the namespace/name key and pod selector of a
+// NetworkPolicy, whichever of the legacy extensions/v1beta1 or
+// networking.k8s.io/v1 types it was decoded as.
+func normalizePolicy(obj interface{}) (string, *policyState, error) {
+	switch np := obj.(type) {
+	case *networkingv1.NetworkPolicy:
+		sel, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "invalid podSelector")
+		}
+		return np.Namespace + "/" + np.Name, &policyState{namespace: np.Namespace, podSelector: sel}, nil
+	case *extnapi.NetworkPolicy:
+		sel, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "invalid podSelector")
+		}
+		return np.Namespace + "/" + np.Name, &policyState{namespace: np.Namespace, podSelector: sel}, nil
+	default:
+		return "", nil, errors.Errorf("unexpected NetworkPolicy type %T", obj)
+	}
+}
+
+// DesiredState renders the current namespace/pod/policy state into the
+// iptables chains and ipsets that should exist for family. Only pods
+// with an IP in that family are considered. Isolated pods get their own
+// WEAVE-NPC-POD-FW-* chain, dispatched into from WEAVE-NPC-INGRESS by a
+// destination match, so a packet only traverses the chain of its
+// destination pod. LocalIpset is rendered alongside the chains with every
+// known pod IP in family, since it's what the per-pod chains' own ACCEPT
+// rule matches against. Pods are rendered in UID order so that unchanged
+// state renders identically on every call. The WEAVE-NPC-EGRESS* chains
+// are not part of the result.
+func (n *NPC) DesiredState(family Family) (map[string][]string, map[ipset.Name][]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	chains := map[string][]string{
+		string(DefaultChain): nil,
+		string(IngressChain): nil,
+	}
+	sets := map[ipset.Name][]string{
+		LocalIpset: nil,
+	}
+
+	uids := make([]string, 0, len(n.pods))
+	for uid := range n.pods {
+		uids = append(uids, string(uid))
+	}
+	sort.Strings(uids)
+
+	for _, uid := range uids {
+		pod := n.pods[types.UID(uid)]
+		ip, ok := pod.ips[family]
+		if !ok {
+			continue
+		}
+
+		sets[LocalIpset] = append(sets[LocalIpset], ip)
+
+		if !n.podIsolatedLocked(pod) {
+			chains[string(DefaultChain)] = append(chains[string(DefaultChain)],
+				"-d "+ip+" -j ACCEPT")
+			continue
+		}
+
+		podChain := PodIngressChain(ip)
+		chains[string(IngressChain)] = append(chains[string(IngressChain)],
+			"-d "+ip+" -j "+podChain)
+		chains[podChain] = n.podIngressRulesLocked(pod)
+	}
+
+	return chains, sets, nil
+}
+
+// podIngressRulesLocked renders pod's own ingress chain: if at least one
+// NetworkPolicy in its namespace selects it, a single ACCEPT for traffic
+// whose source is in LocalIpset (any pod on this node); the policies' own
+// ingress from/ports rules are not translated. The chain is terminated
+// with an explicit DROP so traffic matching none of them is denied instead of
+// falling through to whatever rule WEAVE-NPC-INGRESS happens to have
+// after this pod's dispatch rule.
+func (n *NPC) podIngressRulesLocked(pod *podState) []string {
+	var rules []string
+	for _, p := range n.policies {
+		if p.namespace == pod.namespace && p.podSelector.Matches(pod.labels) {
+			rules = append(rules, "-m set --match-set "+string(LocalIpset)+" src -j ACCEPT")
+			break
+		}
+	}
+	return append(rules, "-j DROP")
+}
+
+// podIsolatedLocked reports whether pod should have ingress default-denied:
+// either its namespace opted in via the legacy annotation, or at least
+// one NetworkPolicy in its namespace selects it (k8s semantics: a pod
+// becomes ingress-isolated as soon as any NetworkPolicy selects it).
+func (n *NPC) podIsolatedLocked(pod *podState) bool {
+	if ns := n.namespaces[pod.namespace]; ns != nil && ns.legacyDefaultDeny {
+		return true
+	}
+	for _, p := range n.policies {
+		if p.namespace == pod.namespace && p.podSelector.Matches(pod.labels) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package npc
+
+import (
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/weaveworks/weave/net/ipset"
+)
+
+// Family identifies an IP address family that weave-npc enforces
+// NetworkPolicy for. Kubernetes pods can carry both an IPv4 and an IPv6
+// address (dual-stack), each of which needs its own iptables chains and
+// ipsets since ip6tables and iptables are entirely separate stacks.
+type Family string
+
+const (
+	FamilyV4 Family = "ipv4"
+	FamilyV6 Family = "ipv6"
+)
+
+// FamilyBackend bundles the iptables/ipset handles and the Reconciler
+// that enforces policy for one address family. weave-npc builds one of
+// these per enabled, kernel-supported family and hands them all to New.
+type FamilyBackend struct {
+	Family     Family
+	IPTables   *iptables.IPTables
+	IPSet      ipset.Interface
+	Reconciler *Reconciler
+}
@@ -0,0 +1,96 @@
+package npc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lastSyncGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "weave_npc",
+	Name:      "last_successful_sync_timestamp_seconds",
+	Help:      "Unix timestamp of the last successful full iptables/ipset reconciliation, by address family.",
+}, []string{"family"})
+
+func init() {
+	prometheus.MustRegister(lastSyncGauge)
+}
+
+// SyncTracker records the outcome of every reconciliation attempt for one
+// address family, so a health endpoint can tell whether the Reconciler
+// is making progress or stuck repeatedly failing to apply iptables/ipset
+// changes.
+type SyncTracker struct {
+	family Family
+	start  time.Time
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
+	lastErrAt   time.Time
+}
+
+// NewSyncTracker creates a SyncTracker for the given address family,
+// timing its initial sync grace period from now.
+func NewSyncTracker(family Family) *SyncTracker {
+	return &SyncTracker{family: family, start: time.Now()}
+}
+
+// RecordSuccess marks a reconciliation that completed at "at" as having
+// succeeded, clearing any in-progress error streak.
+func (t *SyncTracker) RecordSuccess(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSuccess = at
+	t.lastErr = nil
+	lastSyncGauge.WithLabelValues(string(t.family)).Set(float64(at.Unix()))
+}
+
+// RecordError marks a reconciliation that completed at "at" as having
+// failed with err. Only the start time of the current streak of errors
+// is kept, so repeated failures don't reset the grace window.
+func (t *SyncTracker) RecordError(err error, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastErr == nil {
+		t.lastErrAt = at
+	}
+	t.lastErr = err
+}
+
+// LastSuccess returns the time of the last successful reconciliation, or
+// the zero Time if none has succeeded yet.
+func (t *SyncTracker) LastSuccess() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSuccess
+}
+
+// Healthy reports whether the tracked reconciler is still live: it has
+// succeeded within maxAge, and any current streak of errors is no older
+// than errGrace; failing either check makes it unhealthy. Before the
+// first successful sync, it is given
+// the same maxAge grace period from its own creation rather than being
+// reported unhealthy immediately, so a pod isn't killed for not having
+// completed a sync it hasn't had time to attempt yet.
+func (t *SyncTracker) Healthy(maxAge, errGrace time.Duration, now time.Time) (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.lastErr != nil && now.Sub(t.lastErrAt) > errGrace {
+		return false, fmt.Sprintf("%s: reconciliation has been failing since %s: %v",
+			t.family, t.lastErrAt.Format(time.RFC3339), t.lastErr)
+	}
+	if t.lastSuccess.IsZero() {
+		if age := now.Sub(t.start); age > maxAge {
+			return false, fmt.Sprintf("%s: no successful reconciliation %s after starting", t.family, age)
+		}
+		return true, ""
+	}
+	if age := now.Sub(t.lastSuccess); age > maxAge {
+		return false, fmt.Sprintf("%s: last successful reconciliation was %s ago", t.family, age)
+	}
+	return true, ""
+}
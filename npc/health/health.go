@@ -0,0 +1,53 @@
+// Package health serves the /healthz and /readyz endpoints kubelet uses
+// to decide whether weave-npc is ready to receive traffic and whether it
+// should be restarted for having stopped making progress.
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Checker reports readiness and liveness of the reconciliation loop.
+//
+// Ready should only report true once the informers have completed their
+// initial sync and the first full iptables/ipset reconciliation has
+// succeeded. Live should report false if the reconciliation loop hasn't
+// made progress recently, or has been failing for longer than its grace
+// window.
+type Checker interface {
+	Ready() (bool, string)
+	Live() (bool, string)
+}
+
+// Start serves /healthz and /readyz on addr in the background. It
+// returns once the listener is established, mirroring metrics.Start.
+func Start(addr string, checker Checker) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", checkHandler(checker.Ready))
+	mux.HandleFunc("/healthz", checkHandler(checker.Live))
+
+	go func() {
+		_ = http.Serve(ln, mux)
+	}()
+
+	return nil
+}
+
+func checkHandler(check func() (bool, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, msg := check()
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, msg)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
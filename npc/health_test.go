@@ -0,0 +1,78 @@
+package npc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncTrackerHealthy(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxAge := 4 * time.Minute
+	errGrace := 2 * time.Minute
+	errBoom := errors.New("boom")
+
+	cases := []struct {
+		name        string
+		lastSuccess time.Time
+		lastErr     error
+		lastErrAt   time.Time
+		now         time.Time
+		wantHealthy bool
+	}{
+		{
+			name:        "no success yet, still within start grace",
+			now:         start.Add(3 * time.Minute),
+			wantHealthy: true,
+		},
+		{
+			name:        "no success yet, start grace expired",
+			now:         start.Add(5 * time.Minute),
+			wantHealthy: false,
+		},
+		{
+			name:        "recent success",
+			lastSuccess: start.Add(time.Minute),
+			now:         start.Add(2 * time.Minute),
+			wantHealthy: true,
+		},
+		{
+			name:        "stale success",
+			lastSuccess: start,
+			now:         start.Add(5 * time.Minute),
+			wantHealthy: false,
+		},
+		{
+			name:        "erroring but within error grace",
+			lastSuccess: start,
+			lastErr:     errBoom,
+			lastErrAt:   start.Add(time.Minute),
+			now:         start.Add(2 * time.Minute),
+			wantHealthy: true,
+		},
+		{
+			name:        "erroring past error grace",
+			lastSuccess: start,
+			lastErr:     errBoom,
+			lastErrAt:   start.Add(time.Minute),
+			now:         start.Add(4 * time.Minute),
+			wantHealthy: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tr := &SyncTracker{
+				family:      FamilyV4,
+				start:       start,
+				lastSuccess: c.lastSuccess,
+				lastErr:     c.lastErr,
+				lastErrAt:   c.lastErrAt,
+			}
+			healthy, msg := tr.Healthy(maxAge, errGrace, c.now)
+			if healthy != c.wantHealthy {
+				t.Fatalf("Healthy() = %v (%q), want %v", healthy, msg, c.wantHealthy)
+			}
+		})
+	}
+}
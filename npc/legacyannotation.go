@@ -0,0 +1,39 @@
+package npc
+
+import (
+	"encoding/json"
+
+	coreapi "k8s.io/api/core/v1"
+)
+
+// LegacyIsolationAnnotation is the pre-NetworkPolicy-GA per-namespace
+// annotation kube-router also honors: a namespace carrying it opts into
+// default-deny ingress even when it has no NetworkPolicy objects of its
+// own, e.g. "net.beta.kubernetes.io/network-policy":
+// '{"ingress":{"isolation":"DefaultDeny"}}'.
+const LegacyIsolationAnnotation = "net.beta.kubernetes.io/network-policy"
+
+type legacyNetworkPolicyAnnotation struct {
+	Ingress struct {
+		Isolation string `json:"isolation"`
+	} `json:"ingress"`
+}
+
+// IsLegacyDefaultDenyAnnotated reports whether ns carries
+// LegacyIsolationAnnotation with ingress isolation set to "DefaultDeny".
+// A malformed or absent annotation is treated as not requesting
+// isolation, matching how Kubernetes itself ignored the annotation in
+// that case.
+func IsLegacyDefaultDenyAnnotated(ns *coreapi.Namespace) bool {
+	raw, ok := ns.Annotations[LegacyIsolationAnnotation]
+	if !ok {
+		return false
+	}
+
+	var ann legacyNetworkPolicyAnnotation
+	if err := json.Unmarshal([]byte(raw), &ann); err != nil {
+		return false
+	}
+
+	return ann.Ingress.Isolation == "DefaultDeny"
+}
@@ -0,0 +1,47 @@
+package npc
+
+import (
+	"testing"
+
+	coreapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsLegacyDefaultDenyAnnotated(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+	}{
+		{
+			name: "no annotation",
+			want: false,
+		},
+		{
+			name:        "malformed JSON",
+			annotations: map[string]string{LegacyIsolationAnnotation: "{not json"},
+			want:        false,
+		},
+		{
+			name:        "isolation not DefaultDeny",
+			annotations: map[string]string{LegacyIsolationAnnotation: `{"ingress":{"isolation":"Open"}}`},
+			want:        false,
+		},
+		{
+			name:        "DefaultDeny",
+			annotations: map[string]string{LegacyIsolationAnnotation: `{"ingress":{"isolation":"DefaultDeny"}}`},
+			want:        true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ns := &coreapi.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+			}
+			if got := IsLegacyDefaultDenyAnnotated(ns); got != c.want {
+				t.Fatalf("IsLegacyDefaultDenyAnnotated() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package npc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// PodIngressChainPrefix names the per-pod chain of an ingress-isolated
+// pod. WEAVE-NPC-INGRESS dispatches into it with a "-d <podIP> -j <chain>"
+// rule, so a packet only traverses the chain of its destination pod. The
+// chain's rules are rendered by NPC.DesiredState: an ACCEPT for sources in
+// LocalIpset when some NetworkPolicy selects the pod, then a DROP; the
+// policies' ingress from/ports rules are not translated into it.
+//
+// There is no egress counterpart: WEAVE-NPC-EGRESS's rules are the static
+// ones createBaseRules installs once at startup, and NetworkPolicy ingress
+// and egress rules are not parsed anywhere in this package.
+const PodIngressChainPrefix = "WEAVE-NPC-POD-FW-"
+
+// PodIngressChain returns the name of the per-pod ingress chain of the
+// pod with the given IP.
+func PodIngressChain(podIP string) string {
+	return podChainName(PodIngressChainPrefix, podIP)
+}
+
+// podChainName hashes podIP so the resulting chain name fits well within
+// the kernel's 28-character iptables chain name limit regardless of how
+// long the pod's IP string is.
+func podChainName(prefix, podIP string) string {
+	h := sha256.Sum256([]byte(podIP))
+	return prefix + hex.EncodeToString(h[:4])
+}
+
+// IsPodChain reports whether name is a per-pod chain created by
+// PodIngressChain, so that callers resetting the table can find and
+// remove stale ones left behind by pods that no longer exist.
+func IsPodChain(name string) bool {
+	return strings.HasPrefix(name, PodIngressChainPrefix)
+}
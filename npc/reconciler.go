@@ -0,0 +1,337 @@
+package npc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/ipset"
+)
+
+// DesiredStateFunc renders the desired state of the node's iptables chains
+// and ipsets that the Reconciler manages, keyed by chain/set name.
+// NPC.DesiredState renders WEAVE-NPC-DEFAULT, WEAVE-NPC-INGRESS and the
+// per-pod chains; the WEAVE-NPC-EGRESS* chains are not rendered and are
+// left to the static rules installed at startup.
+type DesiredStateFunc func() (chains map[string][]string, sets map[ipset.Name][]string, err error)
+
+// Reconciler periodically renders the desired iptables/ipset state and
+// applies only the chains and sets whose contents changed since the last
+// sync, via a single iptables-restore and a single ipset restore rather
+// than one exec per rule. It is driven both by a ticker (the full sync
+// period) and by Enqueue(), which informers call whenever pod/namespace/
+// policy state changes; bursts of Enqueue() calls are coalesced so that a
+// storm of events triggers at most one sync per minGap.
+type Reconciler struct {
+	period  time.Duration
+	minGap  time.Duration
+	proto   iptables.Protocol
+	desired DesiredStateFunc
+	tracker *SyncTracker
+
+	dirty chan struct{}
+
+	mu        sync.Mutex
+	chainHash map[string]string
+	setHash   map[ipset.Name]string
+}
+
+// NewReconciler creates a Reconciler that applies a resync at least once
+// per period, and no more often than once per minGap, using the
+// iptables/iptables-restore binary pair for proto (so the IPv6
+// FamilyBackend's reconciler drives ip6tables rather than iptables).
+// tracker, which may be nil, is updated with the outcome of every sync so
+// a health endpoint can tell whether the loop is making progress.
+func NewReconciler(period, minGap time.Duration, proto iptables.Protocol, desired DesiredStateFunc, tracker *SyncTracker) *Reconciler {
+	return &Reconciler{
+		period:    period,
+		minGap:    minGap,
+		proto:     proto,
+		desired:   desired,
+		tracker:   tracker,
+		dirty:     make(chan struct{}, 1),
+		chainHash: make(map[string]string),
+		setHash:   make(map[ipset.Name]string),
+	}
+}
+
+// SetDesiredStateFunc wires up the renderer used to compute desired state.
+// It exists separately from NewReconciler because the renderer (the NPC
+// controller) in turn needs a reference to the Reconciler to call Enqueue().
+func (r *Reconciler) SetDesiredStateFunc(desired DesiredStateFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.desired = desired
+}
+
+// Enqueue requests a resync without blocking. If one is already pending it
+// is coalesced into the same sync.
+func (r *Reconciler) Enqueue() {
+	select {
+	case r.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run drives the reconciliation loop until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.period)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.dirty:
+			if wait := r.minGap - time.Since(last); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+			drainDirty(r.dirty)
+		}
+
+		now := time.Now()
+		last = now
+		if err := r.sync(); err != nil {
+			common.Log.Errorf("full reconciliation failed: %v", err)
+			if r.tracker != nil {
+				r.tracker.RecordError(err, now)
+			}
+			continue
+		}
+		if r.tracker != nil {
+			r.tracker.RecordSuccess(now)
+		}
+	}
+}
+
+func drainDirty(dirty chan struct{}) {
+	for {
+		select {
+		case <-dirty:
+		default:
+			return
+		}
+	}
+}
+
+func (r *Reconciler) sync() error {
+	r.mu.Lock()
+	desired := r.desired
+	r.mu.Unlock()
+	if desired == nil {
+		return nil
+	}
+
+	chains, sets, err := desired()
+	if err != nil {
+		return errors.Wrap(err, "render desired state")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// diffChains/diffSets record the new hashes up front; on a failed
+	// apply they are rolled back so the next sync retries those chains
+	// and sets instead of taking them as applied.
+	prevChainHash := make(map[string]string, len(r.chainHash))
+	for name, h := range r.chainHash {
+		prevChainHash[name] = h
+	}
+	if restore, changed := r.diffChains(chains); changed {
+		if err := r.applyIptablesRestore(restore); err != nil {
+			r.chainHash = prevChainHash
+			return errors.Wrap(err, "iptables-restore")
+		}
+	}
+
+	// Chains that vanished from the desired state (e.g. a deleted pod's
+	// per-pod chain) are pruned only after the restore above has applied,
+	// so any dispatch rule that used to jump to them is already gone.
+	if err := r.pruneChains(chains); err != nil {
+		return errors.Wrap(err, "pruning stale chains")
+	}
+
+	prevSetHash := make(map[ipset.Name]string, len(r.setHash))
+	for name, h := range r.setHash {
+		prevSetHash[name] = h
+	}
+	if restore, changed := r.diffSets(sets); changed {
+		if err := applyIpsetRestore(restore); err != nil {
+			r.setHash = prevSetHash
+			return errors.Wrap(err, "ipset restore")
+		}
+	}
+
+	if err := r.pruneSets(sets); err != nil {
+		return errors.Wrap(err, "pruning stale ipsets")
+	}
+
+	return nil
+}
+
+// diffChains hashes each chain's rendered rules and returns an
+// iptables-save-formatted buffer containing only the chains whose hash
+// changed since the last sync.
+func (r *Reconciler) diffChains(chains map[string][]string) ([]byte, bool) {
+	var buf bytes.Buffer
+	changed := false
+
+	buf.WriteString("*" + TableFilter + "\n")
+	for name, rules := range chains {
+		h := hashRules(rules)
+		if r.chainHash[name] == h {
+			continue
+		}
+		changed = true
+		r.chainHash[name] = h
+		buf.WriteString(":" + name + " - [0:0]\n")
+		buf.WriteString("-F " + name + "\n")
+		for _, rule := range rules {
+			buf.WriteString("-A " + name + " " + rule + "\n")
+		}
+	}
+	buf.WriteString("COMMIT\n")
+
+	return buf.Bytes(), changed
+}
+
+// diffSets hashes each ipset's rendered membership and returns an
+// "ipset restore"-formatted buffer containing only the sets whose hash
+// changed since the last sync.
+func (r *Reconciler) diffSets(sets map[ipset.Name][]string) ([]byte, bool) {
+	var buf bytes.Buffer
+	changed := false
+
+	for name, members := range sets {
+		h := hashRules(members)
+		if r.setHash[name] == h {
+			continue
+		}
+		changed = true
+		r.setHash[name] = h
+		buf.WriteString("flush " + string(name) + "\n")
+		for _, m := range members {
+			buf.WriteString("add " + string(name) + " " + m + "\n")
+		}
+	}
+
+	return buf.Bytes(), changed
+}
+
+// pruneChains removes the iptables chains this Reconciler created on a
+// previous sync but that no longer appear in the current desired state,
+// e.g. a per-pod chain belonging to a pod that has since been deleted.
+// iptables-restore has no portable way to delete a chain, so this issues
+// direct iptables(8) invocations instead; it is expected to run rarely
+// compared to the batched restore above.
+func (r *Reconciler) pruneChains(desired map[string][]string) error {
+	for name := range r.chainHash {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := r.runIptables("-t", TableFilter, "-F", name); err != nil {
+			return err
+		}
+		if err := r.runIptables("-t", TableFilter, "-X", name); err != nil {
+			return err
+		}
+		delete(r.chainHash, name)
+	}
+	return nil
+}
+
+// pruneSets destroys ipsets this Reconciler populated on a previous sync
+// but that no longer appear in the current desired state.
+func (r *Reconciler) pruneSets(desired map[ipset.Name][]string) error {
+	for name := range r.setHash {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := runIpset("flush", string(name)); err != nil {
+			return err
+		}
+		if err := runIpset("destroy", string(name)); err != nil {
+			return err
+		}
+		delete(r.setHash, name)
+	}
+	return nil
+}
+
+// iptablesBinary returns the iptables(8) binary for r's address family:
+// ip6tables for IPv6, iptables otherwise.
+func (r *Reconciler) iptablesBinary() string {
+	if r.proto == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// iptablesRestoreBinary is iptablesBinary's counterpart for the
+// iptables-restore(8)/ip6tables-restore(8) batch-load tools.
+func (r *Reconciler) iptablesRestoreBinary() string {
+	if r.proto == iptables.ProtocolIPv6 {
+		return "ip6tables-restore"
+	}
+	return "iptables-restore"
+}
+
+func (r *Reconciler) runIptables(args ...string) error {
+	cmd := exec.Command(r.iptablesBinary(), args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func runIpset(args ...string) error {
+	cmd := exec.Command("ipset", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func hashRules(rules []string) string {
+	h := sha256.New()
+	for _, rule := range rules {
+		h.Write([]byte(rule))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *Reconciler) applyIptablesRestore(buf []byte) error {
+	cmd := exec.Command(r.iptablesRestoreBinary(), "--noflush", "-T", TableFilter)
+	cmd.Stdin = bytes.NewReader(buf)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func applyIpsetRestore(buf []byte) error {
+	if buf == nil {
+		return nil
+	}
+	cmd := exec.Command("ipset", "restore")
+	cmd.Stdin = bytes.NewReader(buf)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/pkg/errors"
@@ -22,20 +25,86 @@ import (
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/ipset"
 	"github.com/weaveworks/weave/npc"
+	"github.com/weaveworks/weave/npc/health"
 	"github.com/weaveworks/weave/npc/metrics"
 	"github.com/weaveworks/weave/npc/ulogd"
 )
 
 var (
-	version     = "unreleased"
-	metricsAddr string
-	logLevel    string
-	allowMcast  bool
-	nodeName    string
-	legacy      bool
-	maxList     int
+	version                                 = "unreleased"
+	metricsAddr                             string
+	logLevel                                string
+	allowMcast                              bool
+	nodeName                                string
+	legacy                                  bool
+	maxList                                 int
+	syncPeriod                              time.Duration
+	enableIPv4                              bool
+	enableIPv6                              bool
+	healthAddr                              string
+	honorLegacyNamespaceIsolationAnnotation bool
 )
 
+// minSyncGap bounds how often a dirty signal from the informers can
+// trigger a full resync, so a storm of pod/policy events coalesces into a
+// single iptables-restore/ipset-restore pass instead of one per event.
+const minSyncGap = 250 * time.Millisecond
+
+// family pairs up the iptables protocol and ipset address family that
+// back one npc.Family, so root() can loop over the enabled families
+// instead of hardcoding IPv4.
+type family struct {
+	name    npc.Family
+	proto   iptables.Protocol
+	ipsetFm ipset.Family
+}
+
+var families = []family{
+	{npc.FamilyV4, iptables.ProtocolIPv4, ipset.FamilyV4},
+	{npc.FamilyV6, iptables.ProtocolIPv6, ipset.FamilyV6},
+}
+
+// maxSyncPeriods is how many sync-periods the reconciliation loop is
+// allowed to go without a successful sync before /healthz reports it
+// wedged.
+const maxSyncPeriods = 4
+
+// syncErrorGrace is how long a reconciliation loop may keep failing
+// before /healthz reports it unhealthy, to tolerate a transient
+// iptables/ipset error without flapping the pod's liveness probe.
+const syncErrorGrace = 2 * time.Minute
+
+// healthChecker answers /healthz and /readyz: readiness requires the
+// informers to have completed their initial sync and every enabled
+// family to have completed at least one reconciliation; liveness
+// requires every family's reconciler to still be making progress.
+type healthChecker struct {
+	synced   func() bool
+	trackers []*npc.SyncTracker
+}
+
+func (h *healthChecker) Ready() (bool, string) {
+	if !h.synced() {
+		return false, "informers have not completed their initial sync"
+	}
+	for _, t := range h.trackers {
+		if t.LastSuccess().IsZero() {
+			return false, "initial iptables/ipset reconciliation has not completed"
+		}
+	}
+	return true, ""
+}
+
+func (h *healthChecker) Live() (bool, string) {
+	now := time.Now()
+	for _, t := range h.trackers {
+		if ok, msg := t.Healthy(time.Duration(maxSyncPeriods)*syncPeriod, syncErrorGrace, now); !ok {
+			return false, msg
+		}
+	}
+	return true, ""
+}
+
 func handleError(err error) { common.CheckFatal(err) }
 
 func makeController(getter cache.Getter, resource string,
@@ -75,6 +144,59 @@ func resetIPTables(ipt *iptables.IPTables) error {
 	// weave-npc process, all egress traffic is allowed for a short period of time.
 	// The chain is created in createBaseRules.
 
+	return deleteStalePodChains(ipt)
+}
+
+// deleteStalePodChains removes every WEAVE-NPC-POD-FW-* chain found at
+// startup, including those of pods deleted while weave-npc was not
+// running. Chains for pods that still exist are recreated by their
+// family's Reconciler once the informers have resynced.
+func deleteStalePodChains(ipt *iptables.IPTables) error {
+	chains, err := ipt.ListChains(npc.TableFilter)
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		if !npc.IsPodChain(chain) {
+			continue
+		}
+		// iptables -X refuses to delete a chain still referenced from
+		// another one, so the dispatch rule in WEAVE-NPC-INGRESS has to
+		// go first.
+		if err := unlinkPodChain(ipt, chain); err != nil {
+			return err
+		}
+		if err := ipt.ClearChain(npc.TableFilter, chain); err != nil {
+			return err
+		}
+		if err := ipt.DeleteChain(npc.TableFilter, chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unlinkPodChain removes any rule in WEAVE-NPC-INGRESS that dispatches
+// into chain.
+func unlinkPodChain(ipt *iptables.IPTables, chain string) error {
+	rules, err := ipt.List(npc.TableFilter, npc.IngressChain)
+	if err != nil {
+		return err
+	}
+
+	// First returned rule is "-N WEAVE-NPC-INGRESS", the rest are "-A WEAVE-NPC-INGRESS ...".
+	for _, rule := range rules[1:] {
+		if !strings.Contains(rule, "-j "+chain) {
+			continue
+		}
+		ruleSpec := strings.Fields(rule)[2:] // drop the leading "-A WEAVE-NPC-INGRESS"
+		if err := ipt.Delete(npc.TableFilter, npc.IngressChain, ruleSpec...); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -261,16 +383,55 @@ func root(cmd *cobra.Command, args []string) {
 	client, err := kubernetes.NewForConfig(config)
 	handleError(err)
 
-	ipt, err := iptables.New()
-	handleError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	ips := ipset.New(common.LogLogger(), maxList)
+	var backends []npc.FamilyBackend
+	var trackers []*npc.SyncTracker
+	for _, f := range families {
+		if (f.name == npc.FamilyV4 && !enableIPv4) || (f.name == npc.FamilyV6 && !enableIPv6) {
+			continue
+		}
 
-	handleError(resetIPTables(ipt))
-	handleError(resetIPSets(ips))
-	handleError(createBaseRules(ipt, ips, legacy))
+		ipt, err := iptables.NewWithProtocol(f.proto)
+		if err != nil {
+			common.Log.Warningf("%s not available, skipping: %v", f.name, err)
+			continue
+		}
+
+		ips := ipset.NewWithFamily(common.LogLogger(), maxList, f.ipsetFm)
 
-	npc := npc.New(nodeName, legacy, ipt, ips)
+		if err := resetIPTables(ipt); err != nil {
+			common.Log.Warningf("%s reset failed, skipping: %v", f.name, err)
+			continue
+		}
+		if err := resetIPSets(ips); err != nil {
+			common.Log.Warningf("%s ipset reset failed, skipping: %v", f.name, err)
+			continue
+		}
+		handleError(createBaseRules(ipt, ips, legacy))
+
+		tracker := npc.NewSyncTracker(f.name)
+		trackers = append(trackers, tracker)
+		backends = append(backends, npc.FamilyBackend{
+			Family:     f.name,
+			IPTables:   ipt,
+			IPSet:      ips,
+			Reconciler: npc.NewReconciler(syncPeriod, minSyncGap, f.proto, nil, tracker),
+		})
+	}
+	if len(backends) == 0 {
+		common.Log.Fatalf("no address family available (enable-ipv4=%v enable-ipv6=%v)", enableIPv4, enableIPv6)
+	}
+
+	npc := npc.New(nodeName, legacy, backends, honorLegacyNamespaceIsolationAnnotation)
+	for _, b := range backends {
+		b := b
+		b.Reconciler.SetDesiredStateFunc(func() (map[string][]string, map[ipset.Name][]string, error) {
+			return npc.DesiredState(b.Family)
+		})
+		go b.Reconciler.Run(ctx)
+	}
 
 	nsController := makeController(client.Core().RESTClient(), "namespaces", &coreapi.Namespace{},
 		cache.ResourceEventHandlerFuncs{
@@ -341,9 +502,26 @@ func root(cmd *cobra.Command, args []string) {
 	go podController.Run(wait.NeverStop)
 	go npController.Run(wait.NeverStop)
 
+	var informersSynced int32
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), nsController.HasSynced, podController.HasSynced, npController.HasSynced) {
+			atomic.StoreInt32(&informersSynced, 1)
+		}
+	}()
+
+	checker := &healthChecker{
+		trackers: trackers,
+		synced:   func() bool { return atomic.LoadInt32(&informersSynced) == 1 },
+	}
+	if err := health.Start(healthAddr, checker); err != nil {
+		common.Log.Fatalf("Failed to start health server: %v", err)
+	}
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	common.Log.Fatalf("Exiting: %v", <-signals)
+	sig := <-signals
+	cancel()
+	common.Log.Fatalf("Exiting: %v", sig)
 }
 
 func main() {
@@ -358,6 +536,13 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&nodeName, "node-name", "", "only generate rules that apply to this node")
 	rootCmd.PersistentFlags().BoolVar(&legacy, "use-legacy-netpol", false, "use legacy network policies (pre k8s 1.7 vsn)")
 	rootCmd.PersistentFlags().IntVar(&maxList, "max-list-size", 1024, "maximum size of ipset list (for namespaces)")
+	rootCmd.PersistentFlags().DurationVar(&syncPeriod, "sync-period", 5*time.Minute,
+		"how often to perform a full iptables/ipset reconciliation, in addition to syncing on every pod/namespace/policy change")
+	rootCmd.PersistentFlags().BoolVar(&enableIPv4, "enable-ipv4", true, "enforce network policy for pods' IPv4 addresses")
+	rootCmd.PersistentFlags().BoolVar(&enableIPv6, "enable-ipv6", true, "enforce network policy for pods' IPv6 addresses")
+	rootCmd.PersistentFlags().StringVar(&healthAddr, "health-addr", ":6782", "health server bind address")
+	rootCmd.PersistentFlags().BoolVar(&honorLegacyNamespaceIsolationAnnotation, "honor-legacy-namespace-isolation-annotation", false,
+		"honor the legacy net.beta.kubernetes.io/network-policy namespace annotation, treating ingress isolation:DefaultDeny as an implicit default-deny-all NetworkPolicy")
 
 	handleError(rootCmd.Execute())
 }